@@ -75,10 +75,18 @@ var (
 	// identityControllerManager contains all controllers used to synchornized
 	// the identities used locally with the kv-store
 	identityControllerManager *controller.Manager
-	// identityRefCountMutex protects the concurrent access of idPoolRefCount
-	identityRefCountMutex lock.Mutex
-	// idPoolRefCount maps an identity the a reference count of its usage.
-	idPoolRefCount map[idpool.ID]uint
+	// identityLocks hands out a per-identity lock for AllocateIdentity and
+	// Release, so that operations on distinct identities do not contend with
+	// each other the way a single global mutex would.
+	identityLocks *idLockManager
+
+	// identityEventRelayDone stops the goroutine fanning allocator events
+	// out to identityEvents.
+	identityEventRelayDone chan struct{}
+
+	// allocatorConfig holds the tunables in effect for the current
+	// allocator, as passed to InitIdentityAllocator.
+	allocatorConfig AllocatorConfig
 )
 
 // IdentityAllocatorOwner is the interface the owner of an identity allocator
@@ -93,8 +101,10 @@ type IdentityAllocatorOwner interface {
 }
 
 // InitIdentityAllocator creates the the identity allocator. Only the first
-// invocation of this function will have an effect.
-func InitIdentityAllocator(owner IdentityAllocatorOwner) {
+// invocation of this function will have an effect. Zero-valued fields of
+// config are replaced by their defaults; pass DefaultAllocatorConfig() for
+// the previous hardcoded behavior.
+func InitIdentityAllocator(owner IdentityAllocatorOwner, config AllocatorConfig) {
 	setupMutex.Lock()
 	defer setupMutex.Unlock()
 
@@ -102,14 +112,24 @@ func InitIdentityAllocator(owner IdentityAllocatorOwner) {
 		log.Panic("InitIdentityAllocator() in succession without calling Close()")
 	}
 
+	allocatorConfig = config.withDefaults()
+
 	identity.InitWellKnownIdentities()
 
 	log.Info("Initializing identity allocator")
 
 	minID := idpool.ID(identity.MinimalAllocationIdentity)
 	maxID := idpool.ID(identity.MaximumAllocationIdentity)
+	rawEvents := make(allocator.AllocatorEventChan, 1024)
 	events := make(allocator.AllocatorEventChan, 1024)
 
+	identityEvents = newIdentityEventHub()
+	identityEventRelayDone = make(chan struct{})
+	// Fan rawEvents out to both the event hub and the watcher: the watcher
+	// keeps consuming the same events it always has, while any number of
+	// external subscribers can now observe them through IdentityEvents().
+	go relayIdentityEvents(rawEvents, events, identityEvents, identityEventRelayDone)
+
 	// It is important to start listening for events before calling
 	// NewAllocator() as it will emit events while filling the
 	// initial cache
@@ -118,7 +138,7 @@ func InitIdentityAllocator(owner IdentityAllocatorOwner) {
 	a, err := allocator.NewAllocator(IdentitiesPath, globalIdentity{},
 		allocator.WithMax(maxID), allocator.WithMin(minID),
 		allocator.WithSuffix(owner.GetNodeSuffix()),
-		allocator.WithEvents(events),
+		allocator.WithEvents(rawEvents),
 		allocator.WithMasterKeyProtection(),
 		allocator.WithPrefixMask(idpool.ID(option.Config.ClusterID<<identity.ClusterIDShift)))
 	if err != nil {
@@ -126,11 +146,11 @@ func InitIdentityAllocator(owner IdentityAllocatorOwner) {
 	}
 
 	identityControllerManager = controller.NewManager()
-	idPoolRefCount = map[idpool.ID]uint{}
+	identityLocks = newIDLockManager()
 
 	IdentityAllocator = a
 	close(identityAllocatorInitialized)
-	localIdentities = newLocalIdentityCache(1, 0xFFFFFF, events)
+	localIdentities = newLocalIdentityCache(1, 0xFFFFFF, rawEvents)
 
 }
 
@@ -149,21 +169,29 @@ func Close() {
 		}
 	}
 
-	identityRefCountMutex.Lock()
-	idPoolRefCount = map[idpool.ID]uint{}
 	identityControllerManager.RemoveAllAndWait()
-	identityRefCountMutex.Unlock()
+	identityLocks.Close()
 
 	IdentityAllocator.Delete()
 	watcher.stop()
+	close(identityEventRelayDone)
+	identityEvents = nil
 	IdentityAllocator = nil
 	identityAllocatorInitialized = make(chan struct{})
 	localIdentities = nil
 }
 
 // WaitForInitialIdentities waits for the initial set of security identities to
-// have been received and populated into the allocator cache
+// have been received and populated into the allocator cache. If
+// AllocatorConfig.InitialSyncTimeout was set, it bounds the wait in addition
+// to ctx.
 func WaitForInitialIdentities(ctx context.Context) error {
+	if allocatorConfig.InitialSyncTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, allocatorConfig.InitialSyncTimeout)
+		defer cancel()
+	}
+
 	select {
 	case <-identityAllocatorInitialized:
 	case <-ctx.Done():
@@ -185,6 +213,51 @@ func IdentityAllocationIsLocal(lbls labels.Labels) bool {
 	return LookupReservedIdentityByLabels(lbls) != nil
 }
 
+// registerSyncController (re-)registers the sync-identity controller that
+// periodically re-allocates id against the backend to keep its lease alive,
+// and wires idLock.resyncCancel so that Release can interrupt the
+// controller's re-allocation wait deterministically instead of only relying
+// on RemoveControllerAndWait to race the ticker. The caller must hold
+// idLock (i.e. have it from identityLocks.acquire) while calling this.
+func registerSyncController(id idpool.ID, lbls labels.Labels, idLock *idRefLock) {
+	resyncCtx, cancel := context.WithCancel(context.Background())
+	idLock.resyncCancel = cancel
+
+	identityControllerManager.UpdateController(fmt.Sprintf("sync-identity (%d)", id),
+		controller.ControllerParams{
+			DoFunc: func(ctx context.Context) error {
+				// We just allocated the identity a couple lines above,
+				// when a controller is added / updated, it starts
+				// immediately, to avoid re-allocating the recently
+				// created identity we will sleep for the (jittered)
+				// reallocation interval first. resyncCtx lets Release
+				// interrupt this wait directly, rather than only going
+				// through the controller's own (racier) teardown.
+				t := time.NewTicker(jitter(allocatorConfig.ReallocationInterval))
+				defer t.Stop()
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					return fmt.Errorf("re-sync cancelled via context: %s", ctx.Err())
+				case <-resyncCtx.Done():
+					return fmt.Errorf("re-sync cancelled deterministically by Release: %s", resyncCtx.Err())
+				}
+
+				opCtx, cancel := context.WithTimeout(ctx, allocatorConfig.BackendOpTimeout)
+				defer cancel()
+
+				start := time.Now()
+				_, _, err := IdentityAllocator.Allocate(opCtx, globalIdentity{lbls})
+				identityReallocationDuration.Observe(time.Since(start).Seconds())
+				return err
+			},
+			// We need to setup a run interval as 0 prevents the controller
+			// from keep running.
+			RunInterval: time.Millisecond,
+		},
+	)
+}
+
 // AllocateIdentity allocates an identity described by the specified labels. If
 // an identity for the specified set of labels already exist, the identity is
 // re-used and reference counting is performed, otherwise a new identity is
@@ -217,39 +290,22 @@ func AllocateIdentity(ctx context.Context, lbls labels.Labels) (*identity.Identi
 		return nil, false, fmt.Errorf("allocator not initialized")
 	}
 
-	id, isNew, err := IdentityAllocator.Allocate(ctx, globalIdentity{lbls})
+	allocCtx, allocCancel := context.WithTimeout(ctx, allocatorConfig.BackendOpTimeout)
+	allocStart := time.Now()
+	id, isNew, err := IdentityAllocator.Allocate(allocCtx, globalIdentity{lbls})
+	identityBackendOpDuration.WithLabelValues("allocate").Observe(time.Since(allocStart).Seconds())
+	allocCancel()
 	if err != nil {
 		return nil, false, err
 	}
 
-	identityRefCountMutex.Lock()
-	refCountNew := idPoolRefCount[id] == 0
+	idLock := identityLocks.acquire(id)
+	refCountNew := idLock.count == 0
 	if refCountNew {
-		identityControllerManager.UpdateController(fmt.Sprintf("sync-identity (%d)", id),
-			controller.ControllerParams{
-				DoFunc: func(ctx context.Context) error {
-					// We just allocated the identity a couple lines above,
-					// when a controller is added / updated, it starts
-					// immediately, to avoid re-allocating the recently identity
-					// we will sleep for 5 minutes
-					t := time.NewTicker(5 * time.Minute)
-					defer t.Stop()
-					select {
-					case <-t.C:
-					case <-ctx.Done():
-						return fmt.Errorf("re-sync cancelled via context: %s", ctx.Err())
-					}
-					_, _, err := IdentityAllocator.Allocate(ctx, globalIdentity{lbls})
-					return err
-				},
-				// We need to setup a run interval as 0 prevents the controller
-				// from keep running.
-				RunInterval: time.Millisecond,
-			},
-		)
+		registerSyncController(id, lbls, idLock)
 	}
-	idPoolRefCount[id]++
-	identityRefCountMutex.Unlock()
+	idLock.count++
+	identityLocks.release(id, idLock)
 
 	log.WithFields(logrus.Fields{
 		logfields.Identity:       id,
@@ -282,24 +338,35 @@ func Release(ctx context.Context, id *identity.Identity) (bool, error) {
 		return false, fmt.Errorf("allocator not initialized")
 	}
 
-	lastUse, err := IdentityAllocator.Release(ctx, globalIdentity{id.Labels})
+	releaseCtx, releaseCancel := context.WithTimeout(ctx, allocatorConfig.BackendOpTimeout)
+	releaseStart := time.Now()
+	lastUse, err := IdentityAllocator.Release(releaseCtx, globalIdentity{id.Labels})
+	identityBackendOpDuration.WithLabelValues("release").Observe(time.Since(releaseStart).Seconds())
+	releaseCancel()
 
 	if err != nil {
 		return false, err
 	}
 
 	idty := idpool.ID(id.ID.Uint32())
-	identityRefCountMutex.Lock()
-	if refCount := idPoolRefCount[idty]; refCount > 0 {
-		lastRef := refCount == 1
+	idLock := identityLocks.acquire(idty)
+	if idLock.count > 0 {
+		lastRef := idLock.count == 1
 		if lastRef {
+			// Interrupt the controller's re-allocation wait deterministically
+			// before asking the controller manager to tear it down, instead
+			// of relying solely on RemoveControllerAndWait's own cancellation
+			// to race the ticker.
+			if idLock.resyncCancel != nil {
+				idLock.resyncCancel()
+			}
 			// As it is the last reference for this identity we can safely remove
 			// its controller
 			identityControllerManager.RemoveControllerAndWait(fmt.Sprintf("sync-identity (%d)", idty))
 		}
-		idPoolRefCount[idty]--
+		idLock.count--
 	}
-	identityRefCountMutex.Unlock()
+	identityLocks.release(idty, idLock)
 
 	return lastUse, nil
 }
@@ -0,0 +1,58 @@
+// Copyright 2018-2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cilium/cilium/pkg/labels"
+)
+
+// TestConcurrencyLimit verifies the token pool size never exceeds the
+// request, and is capped at maxConcurrentGlobalAllocations for larger
+// batches.
+func TestConcurrencyLimit(t *testing.T) {
+	if got := concurrencyLimit(0); got != 0 {
+		t.Fatalf("expected 0 for an empty batch, got %d", got)
+	}
+	if got := concurrencyLimit(5); got != 5 {
+		t.Fatalf("expected a small batch to be unbounded by the cap, got %d", got)
+	}
+	if got := concurrencyLimit(maxConcurrentGlobalAllocations * 10); got != maxConcurrentGlobalAllocations {
+		t.Fatalf("expected a large batch to be capped at %d, got %d", maxConcurrentGlobalAllocations, got)
+	}
+}
+
+// TestAllocateIdentitySliceRequiresAllocatorForGlobalIdentities verifies that
+// AllocateIdentitySlice surfaces a clear error, without panicking, when a
+// batch contains identities that require the global allocator but none has
+// been initialized. identityAllocatorInitialized is never closed in this
+// state, so a short timeout bounds WaitForInitialIdentities' wait for it.
+func TestAllocateIdentitySliceRequiresAllocatorForGlobalIdentities(t *testing.T) {
+	IdentityAllocator = nil
+	localIdentities = nil
+
+	lbls := []labels.Labels{labels.NewLabelsFromModel([]string{"k8s:app=foo"})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, _, err := AllocateIdentitySlice(ctx, lbls)
+	if err == nil {
+		t.Fatalf("expected an error when no allocator is initialized for a global-only batch")
+	}
+}
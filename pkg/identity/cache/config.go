@@ -0,0 +1,87 @@
+// Copyright 2018-2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// defaultReallocationInterval is the interval at which the sync-identity
+	// controller re-allocates an identity against the backend to keep its
+	// lease alive.
+	defaultReallocationInterval = 5 * time.Minute
+	// defaultBackendOpTimeout bounds every individual Allocate/Release call
+	// made against the kvstore backend.
+	defaultBackendOpTimeout = 10 * time.Second
+	// reallocationIntervalJitter is the maximum fraction of
+	// ReallocationInterval by which an individual identity's re-sync is
+	// staggered, to avoid a thundering herd when many identities were
+	// allocated in the same burst.
+	reallocationIntervalJitter = 0.1
+)
+
+// AllocatorConfig contains the configurable parameters of the identity
+// allocator and its associated sync-identity controller. InitIdentityAllocator
+// replaces zero-valued ReallocationInterval and BackendOpTimeout fields with
+// the defaults that DefaultAllocatorConfig returns.
+type AllocatorConfig struct {
+	// ReallocationInterval is the base interval at which the sync-identity
+	// controller re-allocates an identity against the backend. Each
+	// identity's actual interval is jittered around this value.
+	ReallocationInterval time.Duration
+
+	// BackendOpTimeout bounds every individual Allocate/Release call made
+	// against the kvstore backend.
+	BackendOpTimeout time.Duration
+
+	// InitialSyncTimeout bounds how long WaitForInitialIdentities will wait
+	// for the initial cache sync to complete, in addition to whatever
+	// deadline the caller's context already carries. A zero value means no
+	// additional bound is applied.
+	InitialSyncTimeout time.Duration
+}
+
+// DefaultAllocatorConfig returns the configuration used by
+// InitIdentityAllocator if none is given.
+func DefaultAllocatorConfig() AllocatorConfig {
+	return AllocatorConfig{
+		ReallocationInterval: defaultReallocationInterval,
+		BackendOpTimeout:     defaultBackendOpTimeout,
+	}
+}
+
+// withDefaults fills in zero-valued fields of c with their defaults.
+func (c AllocatorConfig) withDefaults() AllocatorConfig {
+	if c.ReallocationInterval == 0 {
+		c.ReallocationInterval = defaultReallocationInterval
+	}
+	if c.BackendOpTimeout == 0 {
+		c.BackendOpTimeout = defaultBackendOpTimeout
+	}
+	return c
+}
+
+// jitter returns d adjusted by up to ±reallocationIntervalJitter, so that
+// many controllers registered around the same time don't all fire at once.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	spread := float64(d) * reallocationIntervalJitter
+	offset := (rand.Float64()*2 - 1) * spread
+	return d + time.Duration(offset)
+}
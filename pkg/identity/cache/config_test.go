@@ -0,0 +1,60 @@
+// Copyright 2018-2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// TestAllocatorConfigWithDefaults verifies that withDefaults only fills in
+// zero-valued fields and leaves explicitly set ones untouched.
+func TestAllocatorConfigWithDefaults(t *testing.T) {
+	c := AllocatorConfig{BackendOpTimeout: 30 * time.Second}.withDefaults()
+
+	if c.ReallocationInterval != defaultReallocationInterval {
+		t.Fatalf("expected ReallocationInterval to default to %s, got %s", defaultReallocationInterval, c.ReallocationInterval)
+	}
+	if c.BackendOpTimeout != 30*time.Second {
+		t.Fatalf("expected BackendOpTimeout to remain 30s, got %s", c.BackendOpTimeout)
+	}
+
+	if d := DefaultAllocatorConfig(); d.ReallocationInterval != defaultReallocationInterval || d.BackendOpTimeout != defaultBackendOpTimeout {
+		t.Fatalf("expected DefaultAllocatorConfig to match the documented defaults, got %+v", d)
+	}
+}
+
+// TestJitter verifies that jitter keeps its result within
+// ±reallocationIntervalJitter of d, and passes non-positive durations
+// through unchanged.
+func TestJitter(t *testing.T) {
+	d := 5 * time.Minute
+	spread := time.Duration(float64(d) * reallocationIntervalJitter)
+	lo, hi := d-spread, d+spread
+
+	for i := 0; i < 100; i++ {
+		got := jitter(d)
+		if got < lo || got > hi {
+			t.Fatalf("jitter(%s) = %s, want within [%s, %s]", d, got, lo, hi)
+		}
+	}
+
+	if got := jitter(0); got != 0 {
+		t.Fatalf("expected jitter(0) to pass through unchanged, got %s", got)
+	}
+	if got := jitter(-time.Second); got != -time.Second {
+		t.Fatalf("expected a negative duration to pass through unchanged, got %s", got)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2018-2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/kvstore/allocator"
+	"github.com/cilium/cilium/pkg/labels"
+	"github.com/cilium/cilium/pkg/lock"
+)
+
+// IdentitySource indicates where an identity referenced by an IdentityEvent
+// originates from.
+type IdentitySource string
+
+const (
+	// IdentitySourceLocal is used for identities allocated out of the
+	// node-local identity cache.
+	IdentitySourceLocal IdentitySource = "local"
+	// IdentitySourceGlobal is used for identities allocated via the kvstore
+	// backed allocator.
+	IdentitySourceGlobal IdentitySource = "global"
+)
+
+// Reserved identities have no IdentitySource value: AllocateIdentity returns
+// them directly from LookupReservedIdentityByLabels before they ever reach
+// rawEvents, so they never flow through the hub this event is published
+// into. Callers that need reserved identities should consult
+// LookupReservedIdentityByLabels/LookupReservedIdentity directly.
+
+// IdentityEventKind distinguishes an identity coming into existence (or
+// gaining a new reference) from one being removed.
+type IdentityEventKind int
+
+const (
+	// IdentityEventUpsert is emitted whenever an identity is allocated or
+	// its entry in the cache otherwise changes.
+	IdentityEventUpsert IdentityEventKind = iota
+	// IdentityEventDelete is emitted whenever an identity is removed from
+	// the cache.
+	IdentityEventDelete
+)
+
+// IdentityEvent describes a single change to the identity cache. Sequence is
+// monotonically increasing per hub and can be used by subscribers to detect
+// gaps caused by a slow consumer missing buffered events.
+type IdentityEvent struct {
+	Kind     IdentityEventKind
+	ID       identity.NumericIdentity
+	Labels   labels.Labels
+	Source   IdentitySource
+	Sequence uint64
+}
+
+// identityEventBufferSize is the number of events buffered per subscriber
+// before the oldest buffered event is dropped in favor of the newest one.
+const identityEventBufferSize = 64
+
+// identityEventSubscription is a single subscriber's buffered view of the
+// hub.
+type identityEventSubscription struct {
+	events chan IdentityEvent
+}
+
+// send delivers ev to the subscriber. If the subscriber's buffer is full,
+// the oldest buffered event is dropped to make room rather than blocking the
+// publisher on a slow consumer.
+func (s *identityEventSubscription) send(ev IdentityEvent) {
+	for {
+		select {
+		case s.events <- ev:
+			return
+		default:
+		}
+
+		select {
+		case <-s.events:
+		default:
+		}
+	}
+}
+
+// identityEventHub multiplexes identity upsert/delete events out to any
+// number of subscribers, replacing the single-consumer hand-off that used to
+// feed allocator events directly (and only) into the watcher. It also keeps
+// the latest event per identity, so that the replay of local and global
+// identities to a newly-subscribed consumer is served from the hub itself
+// without reaching back into IdentityAllocator or localIdentities. Reserved
+// identities are never published into the hub.
+type identityEventHub struct {
+	mutex       lock.Mutex
+	seq         uint64
+	subscribers map[*identityEventSubscription]struct{}
+	snapshot    map[identity.NumericIdentity]IdentityEvent
+}
+
+// newIdentityEventHub returns a ready to use identityEventHub.
+func newIdentityEventHub() *identityEventHub {
+	return &identityEventHub{
+		subscribers: map[*identityEventSubscription]struct{}{},
+		snapshot:    map[identity.NumericIdentity]IdentityEvent{},
+	}
+}
+
+// subscribe registers a new subscriber, replays the hub's current snapshot
+// to it, and returns its event channel along with a function to
+// unsubscribe.
+func (h *identityEventHub) subscribe() (<-chan IdentityEvent, func()) {
+	sub := &identityEventSubscription{events: make(chan IdentityEvent, identityEventBufferSize)}
+
+	h.mutex.Lock()
+	h.subscribers[sub] = struct{}{}
+	replay := make([]IdentityEvent, 0, len(h.snapshot))
+	for _, ev := range h.snapshot {
+		replay = append(replay, ev)
+	}
+	h.mutex.Unlock()
+
+	for _, ev := range replay {
+		sub.send(ev)
+	}
+
+	unsubscribe := func() {
+		h.mutex.Lock()
+		delete(h.subscribers, sub)
+		h.mutex.Unlock()
+		close(sub.events)
+	}
+
+	return sub.events, unsubscribe
+}
+
+// publish assigns the next sequence number to ev, updates the hub's
+// snapshot, and fans it out to every current subscriber.
+func (h *identityEventHub) publish(ev IdentityEvent) {
+	h.mutex.Lock()
+	h.seq++
+	ev.Sequence = h.seq
+
+	if ev.Kind == IdentityEventDelete {
+		delete(h.snapshot, ev.ID)
+	} else {
+		h.snapshot[ev.ID] = ev
+	}
+
+	for sub := range h.subscribers {
+		sub.send(ev)
+	}
+	h.mutex.Unlock()
+}
+
+// get returns the most recently published event for id, if any.
+func (h *identityEventHub) get(id identity.NumericIdentity) (IdentityEvent, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	ev, ok := h.snapshot[id]
+	return ev, ok
+}
+
+// currentEvents returns a snapshot of the hub's latest known event for every
+// identity it has seen, covering both local and global identities since both
+// are published into the same underlying event channel.
+func (h *identityEventHub) currentEvents() []IdentityEvent {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	out := make([]IdentityEvent, 0, len(h.snapshot))
+	for _, ev := range h.snapshot {
+		out = append(out, ev)
+	}
+	return out
+}
+
+// identityEvents is the process-wide hub of identity lifecycle events. It is
+// (re-)created by InitIdentityAllocator and torn down by Close, so it is nil
+// before the allocator has been initialized and after it has been closed.
+var identityEvents *identityEventHub
+
+// IdentityEvents returns a channel of identity lifecycle events together
+// with a function to stop receiving them. Subscribers are first replayed
+// the current cache snapshot, covering both local and global identities, as
+// a burst of IdentityEventUpsert events so they never miss identities that
+// were allocated before they subscribed.
+//
+// If called before InitIdentityAllocator or after Close, it returns an
+// already-closed channel and a no-op cancel function rather than panicking,
+// since callers may reasonably race allocator startup/shutdown.
+func IdentityEvents() (<-chan IdentityEvent, func()) {
+	if identityEvents == nil {
+		closed := make(chan IdentityEvent)
+		close(closed)
+		return closed, func() {}
+	}
+
+	return identityEvents.subscribe()
+}
+
+// relayIdentityEvents drains allocator events from in, republishing a copy
+// of each to the hub before forwarding the original to out so the watcher's
+// existing consumption of the channel keeps working unchanged. It returns
+// once in is closed or done is signalled.
+func relayIdentityEvents(in allocator.AllocatorEventChan, out allocator.AllocatorEventChan, hub *identityEventHub, done <-chan struct{}) {
+	for {
+		select {
+		case ev, ok := <-in:
+			if !ok {
+				close(out)
+				return
+			}
+			hub.publish(toIdentityEvent(ev))
+			select {
+			case out <- ev:
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// toIdentityEvent translates a raw allocator event into the IdentityEvent
+// shape exposed to subscribers.
+func toIdentityEvent(ev allocator.AllocatorEvent) IdentityEvent {
+	kind := IdentityEventUpsert
+	if ev.Typ == kvstore.EventTypeDelete {
+		kind = IdentityEventDelete
+	}
+
+	var lbls labels.Labels
+	if gi, ok := ev.Key.(globalIdentity); ok {
+		lbls = gi.Labels
+	}
+
+	source := IdentitySourceGlobal
+	if !identity.RequiresGlobalIdentity(lbls) {
+		source = IdentitySourceLocal
+	}
+
+	return IdentityEvent{
+		Kind:   kind,
+		ID:     identity.NumericIdentity(ev.ID),
+		Labels: lbls,
+		Source: source,
+	}
+}
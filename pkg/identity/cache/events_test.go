@@ -0,0 +1,144 @@
+// Copyright 2018-2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"testing"
+
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/idpool"
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/kvstore/allocator"
+	"github.com/cilium/cilium/pkg/labels"
+)
+
+// TestIdentityEventHubPublishSubscribe verifies that a subscriber receives
+// events published after it subscribed.
+func TestIdentityEventHubPublishSubscribe(t *testing.T) {
+	h := newIdentityEventHub()
+	events, cancel := h.subscribe()
+	defer cancel()
+
+	h.publish(IdentityEvent{Kind: IdentityEventUpsert, ID: identity.NumericIdentity(100)})
+
+	ev := <-events
+	if ev.ID != identity.NumericIdentity(100) {
+		t.Fatalf("expected ID 100, got %d", ev.ID)
+	}
+	if ev.Sequence != 1 {
+		t.Fatalf("expected sequence 1, got %d", ev.Sequence)
+	}
+}
+
+// TestIdentityEventHubSubscribeReplaysSnapshot verifies that a new subscriber
+// is replayed every identity currently in the snapshot, covering both local
+// and global identities since both are published through the same hub.
+func TestIdentityEventHubSubscribeReplaysSnapshot(t *testing.T) {
+	h := newIdentityEventHub()
+	h.publish(IdentityEvent{Kind: IdentityEventUpsert, ID: identity.NumericIdentity(100), Source: IdentitySourceGlobal})
+	h.publish(IdentityEvent{Kind: IdentityEventUpsert, ID: identity.NumericIdentity(200), Source: IdentitySourceLocal})
+
+	events, cancel := h.subscribe()
+	defer cancel()
+
+	seen := map[identity.NumericIdentity]IdentitySource{}
+	for i := 0; i < 2; i++ {
+		ev := <-events
+		seen[ev.ID] = ev.Source
+	}
+
+	if seen[identity.NumericIdentity(100)] != IdentitySourceGlobal {
+		t.Fatalf("expected global identity 100 to be replayed")
+	}
+	if seen[identity.NumericIdentity(200)] != IdentitySourceLocal {
+		t.Fatalf("expected local identity 200 to be replayed")
+	}
+}
+
+// TestIdentityEventHubDeleteRemovesFromSnapshot verifies that a delete event
+// both removes the identity from the snapshot and is still forwarded to
+// subscribers.
+func TestIdentityEventHubDeleteRemovesFromSnapshot(t *testing.T) {
+	h := newIdentityEventHub()
+	h.publish(IdentityEvent{Kind: IdentityEventUpsert, ID: identity.NumericIdentity(100)})
+	h.publish(IdentityEvent{Kind: IdentityEventDelete, ID: identity.NumericIdentity(100)})
+
+	if _, ok := h.get(identity.NumericIdentity(100)); ok {
+		t.Fatalf("expected identity 100 to be gone from the snapshot after delete")
+	}
+
+	events, cancel := h.subscribe()
+	defer cancel()
+
+	select {
+	case ev := <-events:
+		t.Fatalf("expected no replay for a deleted identity, got %+v", ev)
+	default:
+	}
+}
+
+// TestIdentityEventsNilHub verifies IdentityEvents() does not panic and
+// instead returns an already-closed channel when called before
+// InitIdentityAllocator or after Close.
+func TestIdentityEventsNilHub(t *testing.T) {
+	identityEvents = nil
+
+	events, cancel := IdentityEvents()
+	defer cancel()
+
+	if _, ok := <-events; ok {
+		t.Fatalf("expected an already-closed channel")
+	}
+}
+
+// TestToIdentityEventLocalIdentityRoundTrip verifies that an allocator event
+// for a locally-scoped identity survives translation with its labels and
+// source intact, exercising the ev.Key.(globalIdentity) assertion that
+// relayIdentityEvents relies on for both local and global events.
+func TestToIdentityEventLocalIdentityRoundTrip(t *testing.T) {
+	lbls := labels.NewLabelsFromModel([]string{"k8s:io.cilium.k8s.namespace.labels.project=foo"})
+
+	ev := toIdentityEvent(allocator.AllocatorEvent{
+		Typ: kvstore.EventTypeCreate,
+		ID:  idpool.ID(1000),
+		Key: globalIdentity{lbls},
+	})
+
+	if ev.Kind != IdentityEventUpsert {
+		t.Fatalf("expected IdentityEventUpsert, got %v", ev.Kind)
+	}
+	if ev.Source != IdentitySourceLocal {
+		t.Fatalf("expected IdentitySourceLocal, got %v", ev.Source)
+	}
+	if len(ev.Labels) == 0 {
+		t.Fatalf("expected labels to survive translation, got none")
+	}
+}
+
+// TestToIdentityEventGlobalIdentityRoundTrip verifies that an allocator event
+// for a globally-scoped identity is translated with IdentitySourceGlobal.
+func TestToIdentityEventGlobalIdentityRoundTrip(t *testing.T) {
+	lbls := labels.NewLabelsFromModel([]string{"k8s:app=foo"})
+
+	ev := toIdentityEvent(allocator.AllocatorEvent{
+		Typ: kvstore.EventTypeCreate,
+		ID:  idpool.ID(1001),
+		Key: globalIdentity{lbls},
+	})
+
+	if ev.Source != IdentitySourceGlobal {
+		t.Fatalf("expected IdentitySourceGlobal, got %v", ev.Source)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2018-2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+
+	"github.com/cilium/cilium/pkg/idpool"
+	"github.com/cilium/cilium/pkg/lock"
+)
+
+// idRefLock is the per-identity lock used to serialize the refcounting and
+// sync-identity controller bookkeeping done in AllocateIdentity and Release
+// for a single identity. count and resyncCancel are only ever read or
+// written while mu is held.
+type idRefLock struct {
+	mu    lock.Mutex
+	count uint
+	// users is the number of acquire() callers that hold or are waiting for
+	// mu. Unlike count, it is guarded by idLockManager.mutex.
+	users uint
+	// resyncCancel, if set, deterministically interrupts the sync-identity
+	// controller's re-allocation wait for this identity. Release calls it
+	// before tearing down the controller itself; see registerSyncController
+	// in allocator.go.
+	resyncCancel context.CancelFunc
+}
+
+// idLockManager hands out per-identity locks so that AllocateIdentity and
+// Release calls for different identities can proceed in parallel, replacing
+// the single identityRefCountMutex that previously serialized all of them.
+// Entries are created on first use and removed once their reference count
+// drops back to zero so the map does not grow without bound.
+type idLockManager struct {
+	mutex lock.Mutex
+	locks map[idpool.ID]*idRefLock
+
+	// preAcquireLockHook, if set, is called from acquire() after the map
+	// lookup/create but immediately before blocking on l.mu.Lock(). It only
+	// exists so tests can deterministically observe that a goroutine has
+	// reached that point, and must never be set outside of tests.
+	preAcquireLockHook func(id idpool.ID)
+}
+
+// newIDLockManager returns a ready to use idLockManager.
+func newIDLockManager() *idLockManager {
+	return &idLockManager{
+		locks: map[idpool.ID]*idRefLock{},
+	}
+}
+
+// acquire returns the lock for id, creating it if necessary, and locks it.
+// The caller must pair this with a call to release once it is done mutating
+// the identity's refcount.
+func (m *idLockManager) acquire(id idpool.ID) *idRefLock {
+	m.mutex.Lock()
+	l, ok := m.locks[id]
+	if !ok {
+		l = &idRefLock{}
+		m.locks[id] = l
+	}
+	l.users++
+	m.mutex.Unlock()
+
+	if m.preAcquireLockHook != nil {
+		m.preAcquireLockHook(id)
+	}
+
+	l.mu.Lock()
+	return l
+}
+
+// release unlocks l and, if its reference count has dropped to zero and no
+// other acquire() caller holds or is waiting for it, removes it from the map
+// so the entry does not leak. acquire() registers itself in l.users under
+// m.mutex before it blocks on l.mu, so an entry that a concurrent acquire()
+// has already looked up is never deleted from under it.
+func (m *idLockManager) release(id idpool.ID, l *idRefLock) {
+	m.mutex.Lock()
+	l.users--
+	if l.count == 0 && l.users == 0 {
+		// Only delete the entry if it is still the one we released: a
+		// concurrent acquire() may have already replaced it in the map.
+		if cur, ok := m.locks[id]; ok && cur == l {
+			delete(m.locks, id)
+		}
+	}
+	l.mu.Unlock()
+	m.mutex.Unlock()
+}
+
+// Close drains all outstanding per-identity locks, blocking until any
+// allocation or release in flight for each identity has finished, and
+// discards them. It is safe to call concurrently with acquire/release, but
+// callers must not use the manager afterwards.
+func (m *idLockManager) Close() {
+	m.mutex.Lock()
+	locks := m.locks
+	m.locks = map[idpool.ID]*idRefLock{}
+	m.mutex.Unlock()
+
+	for _, l := range locks {
+		l.mu.Lock()
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2018-2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cilium/cilium/pkg/idpool"
+)
+
+// TestIDLockManagerReleaseDoesNotOrphanLiveEntry reproduces the scenario
+// where a release() racing a concurrent acquire()+release() on the same id
+// could previously delete a map entry whose refcount had already been
+// bumped back up, orphaning it.
+func TestIDLockManagerReleaseDoesNotOrphanLiveEntry(t *testing.T) {
+	m := newIDLockManager()
+	id := idpool.ID(1)
+
+	l1 := m.acquire(id)
+	l1.count++
+
+	// reachedMapLookup confirms the goroutine has found l1 in m.locks via
+	// m.mutex (and so is about to block on l1.mu.Lock()), not merely that it
+	// has started: acquire()'s map lookup happens-before its l.mu.Lock(), so
+	// waiting on this is enough to guarantee the goroutine is genuinely
+	// blocked on l1.mu before the main goroutine releases it below.
+	reachedMapLookup := make(chan struct{})
+	m.preAcquireLockHook = func(gotID idpool.ID) {
+		if gotID == id {
+			close(reachedMapLookup)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l2 := m.acquire(id) // blocks on l1.mu until l1 is released below
+		l2.count++
+		m.release(id, l2)
+	}()
+	<-reachedMapLookup
+
+	l1.count--
+	m.release(id, l1)
+	wg.Wait()
+
+	m.mutex.Lock()
+	entry, ok := m.locks[id]
+	m.mutex.Unlock()
+	if !ok {
+		t.Fatalf("expected a live entry for id %d to remain in the map", id)
+	}
+	if entry.count != 1 {
+		t.Fatalf("expected refcount 1 for id %d, got %d", id, entry.count)
+	}
+}
+
+// TestIDLockManagerRemovesDrainedEntry verifies the common case: once the
+// last reference is released, the entry is removed so the map does not
+// grow without bound.
+func TestIDLockManagerRemovesDrainedEntry(t *testing.T) {
+	m := newIDLockManager()
+	id := idpool.ID(42)
+
+	l := m.acquire(id)
+	l.count++
+	m.release(id, l)
+
+	l = m.acquire(id)
+	l.count--
+	m.release(id, l)
+
+	m.mutex.Lock()
+	_, ok := m.locks[id]
+	m.mutex.Unlock()
+	if ok {
+		t.Fatalf("expected entry for id %d to be removed once drained", id)
+	}
+}
+
+// BenchmarkIDLockManagerParallelDistinctIdentities allocates/releases a
+// large pool of distinct identities concurrently. Run with
+// `go test -bench=. -cpu=1,2,4,8` to observe scaling with GOMAXPROCS: since
+// each goroutine mostly touches a different identity's lock, throughput
+// should scale with the number of CPUs, unlike a single global mutex which
+// would serialize all of them regardless of how many identities are in
+// play.
+func BenchmarkIDLockManagerParallelDistinctIdentities(b *testing.B) {
+	m := newIDLockManager()
+
+	const identityPoolSize = 4096
+	var next uint64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			id := idpool.ID(atomic.AddUint64(&next, 1) % identityPoolSize)
+			l := m.acquire(id)
+			l.count++
+			l.count--
+			m.release(id, l)
+		}
+	})
+}
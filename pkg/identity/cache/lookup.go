@@ -0,0 +1,91 @@
+// Copyright 2018-2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/labels"
+)
+
+// IdentitySourceFilter restricts LookupIdentitiesByLabels to identities from
+// the listed sources (IdentitySourceLocal, IdentitySourceGlobal). A nil or
+// empty filter matches identities from any source. Reserved identities are
+// never covered, with or without a filter: see the note on IdentitySource.
+type IdentitySourceFilter map[IdentitySource]bool
+
+// matches reports whether source passes the filter.
+func (f IdentitySourceFilter) matches(source IdentitySource) bool {
+	return len(f) == 0 || f[source]
+}
+
+// LookupIdentityByID looks up the identity for the given numeric ID among
+// the currently known local and global identities. It returns nil if id is
+// not currently allocated.
+//
+// Reserved identities are not covered: they are well-known and never flow
+// through the event hub this is backed by.
+func LookupIdentityByID(id identity.NumericIdentity) *identity.Identity {
+	if identityEvents == nil {
+		return nil
+	}
+
+	ev, ok := identityEvents.get(id)
+	if !ok {
+		return nil
+	}
+
+	return identity.NewIdentity(id, ev.Labels)
+}
+
+// LookupIdentitiesByLabels scans the known local and global identities for
+// every one whose labels are a superset of selector, i.e. every label in
+// selector is present on the identity (an "all-labels-present" match, not an
+// exact match), optionally restricted to the given sources. This mirrors
+// the filtering done by the daemon's GET /identity handler, but runs
+// in-process so policy code, the CLI, and metrics can query the identity
+// space without going through the REST layer or racing on the allocator's
+// internal maps.
+//
+// Reserved identities are not covered: they are well-known and never flow
+// through the event hub this is backed by.
+func LookupIdentitiesByLabels(selector labels.LabelArray, sources IdentitySourceFilter) []*identity.Identity {
+	if identityEvents == nil {
+		return nil
+	}
+
+	var matches []*identity.Identity
+	for _, ev := range identityEvents.currentEvents() {
+		if !sources.matches(ev.Source) {
+			continue
+		}
+		if identityMatchesSelector(ev.Labels, selector) {
+			matches = append(matches, identity.NewIdentity(ev.ID, ev.Labels))
+		}
+	}
+
+	return matches
+}
+
+// identityMatchesSelector reports whether every label in selector is present
+// in lbls with a matching value.
+func identityMatchesSelector(lbls labels.Labels, selector labels.LabelArray) bool {
+	for _, l := range selector {
+		have, ok := lbls[l.Key]
+		if !ok || have.Value != l.Value {
+			return false
+		}
+	}
+	return true
+}
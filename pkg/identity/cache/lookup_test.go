@@ -0,0 +1,98 @@
+// Copyright 2018-2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"testing"
+
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/labels"
+)
+
+// TestLookupIdentityByID verifies the nil-hub and found/not-found cases.
+func TestLookupIdentityByID(t *testing.T) {
+	identityEvents = nil
+	if id := LookupIdentityByID(identity.NumericIdentity(100)); id != nil {
+		t.Fatalf("expected nil lookup before the hub exists, got %+v", id)
+	}
+
+	identityEvents = newIdentityEventHub()
+	defer func() { identityEvents = nil }()
+
+	lbls := labels.NewLabelsFromModel([]string{"k8s:app=foo"})
+	identityEvents.publish(IdentityEvent{Kind: IdentityEventUpsert, ID: identity.NumericIdentity(100), Labels: lbls, Source: IdentitySourceGlobal})
+
+	if id := LookupIdentityByID(identity.NumericIdentity(200)); id != nil {
+		t.Fatalf("expected nil lookup for an unknown identity, got %+v", id)
+	}
+
+	id := LookupIdentityByID(identity.NumericIdentity(100))
+	if id == nil {
+		t.Fatalf("expected to find identity 100")
+	}
+	if len(id.Labels) != len(lbls) {
+		t.Fatalf("expected labels to be carried over, got %+v", id.Labels)
+	}
+}
+
+// TestLookupIdentitiesByLabelsSourceFilter verifies that
+// LookupIdentitiesByLabels honors IdentitySourceFilter and that a nil/empty
+// filter matches every source.
+func TestLookupIdentitiesByLabelsSourceFilter(t *testing.T) {
+	identityEvents = newIdentityEventHub()
+	defer func() { identityEvents = nil }()
+
+	lbls := labels.NewLabelsFromModel([]string{"k8s:app=foo"})
+	identityEvents.publish(IdentityEvent{Kind: IdentityEventUpsert, ID: identity.NumericIdentity(100), Labels: lbls, Source: IdentitySourceGlobal})
+	identityEvents.publish(IdentityEvent{Kind: IdentityEventUpsert, ID: identity.NumericIdentity(200), Labels: lbls, Source: IdentitySourceLocal})
+
+	selector := labels.LabelArray{labels.ParseSelectLabel("k8s:app=foo")}
+
+	all := LookupIdentitiesByLabels(selector, nil)
+	if len(all) != 2 {
+		t.Fatalf("expected an empty filter to match both identities, got %d", len(all))
+	}
+
+	global := LookupIdentitiesByLabels(selector, IdentitySourceFilter{IdentitySourceGlobal: true})
+	if len(global) != 1 || global[0].ID != identity.NumericIdentity(100) {
+		t.Fatalf("expected only the global identity to match, got %+v", global)
+	}
+
+	none := LookupIdentitiesByLabels(labels.LabelArray{labels.ParseSelectLabel("k8s:app=bar")}, nil)
+	if len(none) != 0 {
+		t.Fatalf("expected no matches for a selector with no matching identities, got %+v", none)
+	}
+}
+
+// TestIdentityMatchesSelector verifies the "all selector labels present with
+// a matching value" semantics directly.
+func TestIdentityMatchesSelector(t *testing.T) {
+	lbls := labels.NewLabelsFromModel([]string{"k8s:app=foo", "k8s:env=prod"})
+
+	matching := labels.LabelArray{labels.ParseSelectLabel("k8s:app=foo")}
+	if !identityMatchesSelector(lbls, matching) {
+		t.Fatalf("expected selector subset of labels to match")
+	}
+
+	mismatched := labels.LabelArray{labels.ParseSelectLabel("k8s:app=bar")}
+	if identityMatchesSelector(lbls, mismatched) {
+		t.Fatalf("expected a mismatched label value not to match")
+	}
+
+	missing := labels.LabelArray{labels.ParseSelectLabel("k8s:missing=foo")}
+	if identityMatchesSelector(lbls, missing) {
+		t.Fatalf("expected a missing label not to match")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2018-2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cilium/cilium/pkg/metrics"
+)
+
+var (
+	// identityReallocationDuration observes how long each sync-identity
+	// controller run takes to re-allocate its identity against the backend.
+	identityReallocationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "identity",
+		Name:      "reallocation_duration_seconds",
+		Help:      "Duration of periodic identity re-allocation against the backend",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// identityBackendOpDuration observes the latency of individual
+	// allocator backend operations, labelled by operation name.
+	identityBackendOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "identity",
+		Name:      "backend_op_duration_seconds",
+		Help:      "Duration of identity allocator backend operations",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+)
+
+func init() {
+	metrics.MustRegister(identityReallocationDuration)
+	metrics.MustRegister(identityBackendOpDuration)
+}